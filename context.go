@@ -2,6 +2,7 @@ package recontext
 
 import (
 	"errors"
+	"net"
 	"reflect"
 	"sync"
 	"sync/atomic"
@@ -87,6 +88,14 @@ func withCancel(parent Context) *cancelCtx {
 	return c
 }
 
+// WithCancelCause はWithCancelと同様にcancel可能なcontextを返しますが、
+// 返されるCancelCauseFuncにcauseを渡すことでcancelの原因を指定できます
+// causeにnilを渡した場合はCanceledがcauseとして設定されます
+func WithCancelCause(parent Context) (ctx Context, cancel CancelCauseFunc) {
+	c := withCancel(parent)
+	return c, func(cause error) { c.cancel(true, Canceled, cause) }
+}
+
 var cancelCtxKey int
 
 // Cause は &cancelCtxKeyを用いて &cancelCtxを取得し
@@ -101,20 +110,49 @@ func Cause(c Context) error {
 }
 
 // propagateCancel は親がcancelされたときにそれを子に伝搬します
-// selectを用いて常にキャンセルされるかどうかを確認しています
+// parentがcancelCtxであればchildをparent.childrenに登録し、
+// parent.cancelのタイミングで直接伝搬させます
+// parentがcancelCtx以外のContext実装だった場合は、
+// goroutineを立ち上げてDoneチャネルを監視することで伝搬します
 func propagateCancel(parent Context, child canceler) {
 	done := parent.Done()
 	if done == nil {
 		return //parentはキャンセルされない
 	}
-	
+
 	select {
-	// キャンセル待機
+	// すでにparentがcancelされていた場合は即座に子へ伝搬する
 	case <-done:
 		child.cancel(false, parent.Err(), Cause(parent))
 		return
 	default:
 	}
+
+	if p, ok := parentCancelCtx(parent); ok {
+		p.mu.Lock()
+		if p.err != nil {
+			// ロック取得までの間にcancelされていた場合
+			child.cancel(false, p.err, p.cause)
+		} else {
+			if p.children == nil {
+				p.children = make(map[canceler]struct{})
+			}
+			p.children[child] = struct{}{}
+		}
+		p.mu.Unlock()
+		return
+	}
+
+	// parentがcancelCtxとして認識できない独自実装のContextだった場合、
+	// goroutineを立ち上げてDoneの伝搬を監視する
+	// childが先にcancelされた場合はgoroutineもそこで終了する
+	go func() {
+		select {
+		case <-parent.Done():
+			child.cancel(false, parent.Err(), Cause(parent))
+		case <-child.Done():
+		}
+	}()
 }
 
 // 親がキャンセルされてない、かつcancelCtxだった場合、
@@ -164,6 +202,66 @@ type canceler interface {
 	Done() <-chan struct{}
 }
 
+// afterFuncCtx はAfterFuncで登録したcallbackを保持するための箱です
+// mapのキーとして使うため中身ではなく自身のポインタで識別します
+type afterFuncCtx struct {
+	f func()
+}
+
+// AfterFunc はctxがdone(cancelまたはdeadline超過、あるいは呼び出し時点ですでにdone)になった際に
+// fを別goroutineで実行するよう登録します
+// 返されるstopはこの登録を取り消し、fの実行を止められた場合にtrueを返します
+func AfterFunc(ctx Context, f func()) (stop func() bool) {
+	a := &afterFuncCtx{f: f}
+
+	if cc, ok := ctx.Value(&cancelCtxKey).(*cancelCtx); ok {
+		cc.mu.Lock()
+		if cc.err != nil {
+			// すでにdoneだったので即座にfを起動する
+			cc.mu.Unlock()
+			go f()
+			return func() bool { return false }
+		}
+		if cc.afterFuncs == nil {
+			cc.afterFuncs = make(map[*afterFuncCtx]struct{})
+		}
+		cc.afterFuncs[a] = struct{}{}
+		cc.mu.Unlock()
+
+		return func() bool {
+			cc.mu.Lock()
+			_, registered := cc.afterFuncs[a]
+			delete(cc.afterFuncs, a)
+			cc.mu.Unlock()
+			return registered
+		}
+	}
+
+	// ctxがcancelCtxとして認識できない独自実装のContextだった場合は
+	// goroutineでDoneを監視するフォールバックを使う
+	stopCh := make(chan struct{})
+	stopped := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f()
+			stopped <- false
+		case <-stopCh:
+			stopped <- true
+		}
+	}()
+
+	var once sync.Once
+	var result bool
+	return func() bool {
+		once.Do(func() {
+			close(stopCh)
+			result = <-stopped
+		})
+		return result
+	}
+}
+
 // closedchan は再利用可能なすでにcancelされたチャネル
 var closedchan = make(chan struct{})
 
@@ -182,6 +280,10 @@ type cancelCtx struct {
 	children map[canceler]struct{}
 	err      error
 	cause    error
+
+	// afterFuncs はAfterFuncによって登録されたcallbackの集合です
+	// cancel時にこのmuを保持したまままとめて起動します
+	afterFuncs map[*afterFuncCtx]struct{}
 }
 
 func (c *cancelCtx) Value(key any) any {
@@ -276,6 +378,13 @@ func (c *cancelCtx) cancel(removeFromParent bool, err, cause error) {
 	}
 
 	c.children = nil
+
+	// 登録されていたAfterFuncのcallbackをそれぞれ別goroutineで起動する
+	for a := range c.afterFuncs {
+		go a.f()
+	}
+	c.afterFuncs = nil
+
 	c.mu.Unlock()
 
 	if removeFromParent {
@@ -284,6 +393,100 @@ func (c *cancelCtx) cancel(removeFromParent bool, err, cause error) {
 	}
 }
 
+// deadlineExceededError はdeadlineを過ぎた際にcancelの原因として設定されるerrorです
+// net.Errorを満たすようTimeout,Temporaryを実装しています
+type deadlineExceededError struct{}
+
+func (deadlineExceededError) Error() string   { return "context deadline exceeded" }
+func (deadlineExceededError) Timeout() bool   { return true }
+func (deadlineExceededError) Temporary() bool { return true }
+
+// DeadlineExceeded はdeadlineやtimeoutを過ぎたcontextがcancelされる際のerrです
+var DeadlineExceeded error = deadlineExceededError{}
+
+var _ net.Error = DeadlineExceeded.(net.Error)
+
+// timerCtx はcancelCtxにdeadlineとそれを実現するためのtimerを持たせたcontextです
+type timerCtx struct {
+	*cancelCtx
+	timer *time.Timer
+
+	deadline time.Time
+}
+
+func (c *timerCtx) Deadline() (deadline time.Time, ok bool) {
+	return c.deadline, true
+}
+
+// cancel はcancelCtxのcancelを呼び出したあと、自身の持つtimerを止めます
+// removeFromParentはcancelCtx側では使わず、timerCtxとして親から削除する必要があるため
+// ここで改めてremoveChildを呼び出しています
+func (c *timerCtx) cancel(removeFromParent bool, err, cause error) {
+	c.cancelCtx.cancel(false, err, cause)
+	if removeFromParent {
+		removeChild(c.cancelCtx.Context, c)
+	}
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.mu.Unlock()
+}
+
+// WithDeadline はdにcancelされるcontextを返します
+// すでにparentのdeadlineの方が早い場合は、WithCancelと同様の挙動になります
+// (子が親より先にcancelされることはないため、新しくtimerを用意する意味がない)
+func WithDeadline(parent Context, d time.Time) (Context, CancelFunc) {
+	if parent == nil {
+		panic("cannot create context from nil parent")
+	}
+	if cur, ok := parent.Deadline(); ok && cur.Before(d) {
+		// parentの方が先にcancelされるのでtimerは不要
+		return WithCancel(parent)
+	}
+
+	c := &timerCtx{
+		cancelCtx: newCancelCtx(parent),
+		deadline:  d,
+	}
+	propagateCancel(parent, c)
+
+	dur := time.Until(d)
+	if dur <= 0 {
+		// すでにdeadlineを過ぎている場合は即座にcancelする
+		c.cancel(true, DeadlineExceeded, DeadlineExceeded)
+		return c, func() { c.cancel(false, Canceled, nil) }
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.timer = time.AfterFunc(dur, func() {
+			c.cancel(true, DeadlineExceeded, DeadlineExceeded)
+		})
+	}
+	return c, func() { c.cancel(true, Canceled, nil) }
+}
+
+// WithTimeout はtimeout後にcancelされるcontextを返します
+// WithDeadline(parent, time.Now().Add(timeout))のショートハンドです
+func WithTimeout(parent Context, timeout time.Duration) (Context, CancelFunc) {
+	return WithDeadline(parent, time.Now().Add(timeout))
+}
+
+// valueCacheThreshold はvalueCtxのチェーンがこの深さ以上になった場合に
+// Valueのキャッシュを有効にするかどうかのしきい値です
+// SetValueCacheThresholdで変更できます
+var valueCacheThreshold int32 = 8
+
+// SetValueCacheThreshold はWithValueのチェーンが深くなった際に
+// 祖先のkey/valueをキャッシュし始める深さのしきい値を変更します
+// 1以下を指定した場合はすべてのvalueCtxでキャッシュを利用します
+func SetValueCacheThreshold(n int) {
+	atomic.StoreInt32(&valueCacheThreshold, int32(n))
+}
+
 // WithValue はparentとなるContextを埋め込んだvalueCtxを返す
 func WithValue(parent Context,key ,val any) Context {
 	if parent == nil {
@@ -297,13 +500,28 @@ func WithValue(parent Context,key ,val any) Context {
 		panic("key is not comparable")
 	}
 
-	return &valueCtx{parent,key ,val}
+	depth := 1
+	if p, ok := parent.(*valueCtx); ok {
+		depth = p.depth + 1
+	}
+
+	return &valueCtx{Context: parent, key: key, val: val, depth: depth}
 }
 
 // valueCtx はkeyとvalueの伝搬の役割をもつContextです
+// WithValueのチェーンが深くなると祖先を辿るValueはO(n)になってしまうため、
+// depthがvalueCacheThreshold以上の場合は一度だけ祖先を辿ってcacheを作り、
+// 以降のValue呼び出しをO(1)にします
+// cacheにないkeyは従来どおりvalue関数で祖先を辿ります
 type valueCtx struct {
 	Context
 	key, val any
+
+	// depth は自身を含めた連続するvalueCtxチェーンの長さです
+	depth int
+
+	cacheOnce sync.Once
+	cache     map[any]any
 }
 
 // stringifyはfmtパッケージを使わずに引数vの文字列化をします
@@ -327,9 +545,42 @@ func (c *valueCtx) Value(key any) any {
 	if c.key == key {
 		return c.val
 	}
+
+	if c.depth >= int(atomic.LoadInt32(&valueCacheThreshold)) {
+		c.cacheOnce.Do(c.buildCache)
+		if v, ok := c.cache[key]; ok {
+			return v
+		}
+	}
+
 	return value(c.Context,key)
 }
 
+// buildCache はvalueCtxのチェーンを遡って祖先のkey/valueをまとめてcに記録します
+// 同じkeyが複数回現れた場合は自身に近い(後からWithValueされた)方を優先します
+// valueCtxとcancelCtxの並びはvalue関数と同じ考え方で辿っています
+func (c *valueCtx) buildCache() {
+	cache := make(map[any]any, c.depth)
+
+	var ctx Context = c
+	for {
+		switch v := ctx.(type) {
+		case *valueCtx:
+			if _, exists := cache[v.key]; !exists {
+				cache[v.key] = v.val
+			}
+			ctx = v.Context
+		case *cancelCtx:
+			ctx = v.Context
+		case *timerCtx:
+			ctx = v.cancelCtx.Context
+		default:
+			c.cache = cache
+			return
+		}
+	}
+}
+
 func value(c Context,key any) any {
 	for {
 		switch ctx := c.(type) {
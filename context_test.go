@@ -2,7 +2,11 @@ package recontext
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"runtime"
 	"testing"
+	"time"
 )
 
 
@@ -32,4 +36,322 @@ func TestBackground(t *testing.T) {
 			}
 		})
 	}
+}
+
+// fakeCtx はcancelCtxとして認識されない、第三者が実装したContextを模したものです
+type fakeCtx struct {
+	done chan struct{}
+	err  error
+}
+
+func (f *fakeCtx) Deadline() (deadline time.Time, ok bool) { return }
+func (f *fakeCtx) Done() <-chan struct{}                   { return f.done }
+func (f *fakeCtx) Err() error                               { return f.err }
+func (f *fakeCtx) Value(key any) any                        { return nil }
+
+func TestPropagateCancelReachesGrandchild(t *testing.T) {
+	root, cancel := WithCancel(Background())
+	child, _ := WithCancel(root)
+	grandchild, _ := WithCancel(child)
+
+	cancel()
+
+	select {
+	case <-grandchild.Done():
+	case <-time.After(time.Second):
+		t.Fatal("grandchild was not canceled after root was canceled")
+	}
+
+	if err := grandchild.Err(); err != Canceled {
+		t.Fatalf("grandchild.Err() = %v, want %v", err, Canceled)
+	}
+}
+
+func TestWithCancelCauseCustomCause(t *testing.T) {
+	myErr := errors.New("custom cause")
+	ctx, cancel := WithCancelCause(Background())
+
+	cancel(myErr)
+
+	if err := ctx.Err(); err != Canceled {
+		t.Fatalf("ctx.Err() = %v, want %v", err, Canceled)
+	}
+	if cause := Cause(ctx); cause != myErr {
+		t.Fatalf("Cause(ctx) = %v, want %v", cause, myErr)
+	}
+}
+
+func TestWithCancelCauseNilDefaultsToCanceled(t *testing.T) {
+	ctx, cancel := WithCancelCause(Background())
+
+	cancel(nil)
+
+	if err := ctx.Err(); err != Canceled {
+		t.Fatalf("ctx.Err() = %v, want %v", err, Canceled)
+	}
+	if cause := Cause(ctx); cause != Canceled {
+		t.Fatalf("Cause(ctx) = %v, want %v", cause, Canceled)
+	}
+}
+
+func TestWithCancelCausePropagatesToGrandchild(t *testing.T) {
+	myErr := errors.New("ancestor cause")
+	root, cancel := WithCancelCause(Background())
+	child, _ := WithCancel(root)
+	grandchild, _ := WithCancel(child)
+
+	cancel(myErr)
+
+	select {
+	case <-grandchild.Done():
+	case <-time.After(time.Second):
+		t.Fatal("grandchild was not canceled after root was canceled")
+	}
+
+	if cause := Cause(grandchild); cause != myErr {
+		t.Fatalf("Cause(grandchild) = %v, want %v", cause, myErr)
+	}
+}
+
+func TestAfterFuncRunsOnCancel(t *testing.T) {
+	ctx, cancel := WithCancel(Background())
+	done := make(chan struct{})
+
+	AfterFunc(ctx, func() { close(done) })
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("AfterFunc callback did not run after cancel")
+	}
+}
+
+func TestAfterFuncStopPreventsCall(t *testing.T) {
+	ctx, cancel := WithCancel(Background())
+	defer cancel()
+
+	called := make(chan struct{}, 1)
+	stop := AfterFunc(ctx, func() { called <- struct{}{} })
+
+	if !stop() {
+		t.Fatal("stop() = false, want true before cancel")
+	}
+
+	cancel()
+
+	select {
+	case <-called:
+		t.Fatal("AfterFunc callback ran after being stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWithTimeoutFires(t *testing.T) {
+	ctx, cancel := WithTimeout(Background(), 10*time.Millisecond)
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("ctx was not done after timeout elapsed")
+	}
+
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Fatalf("ctx.Err() = %v, want %v", err, DeadlineExceeded)
+	}
+}
+
+func TestWithDeadlinePastCancelsImmediately(t *testing.T) {
+	ctx, cancel := WithDeadline(Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("ctx.Done() was not already closed for a past deadline")
+	}
+
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Fatalf("ctx.Err() = %v, want %v", err, DeadlineExceeded)
+	}
+}
+
+func TestWithDeadlineLaterThanParentUsesParentDeadline(t *testing.T) {
+	parentDeadline := time.Now().Add(10 * time.Millisecond)
+	parent, parentCancel := WithDeadline(Background(), parentDeadline)
+	defer parentCancel()
+
+	ctx, cancel := WithDeadline(parent, parentDeadline.Add(time.Hour))
+	defer cancel()
+
+	gotDeadline, ok := ctx.Deadline()
+	if !ok || !gotDeadline.Equal(parentDeadline) {
+		t.Fatalf("ctx.Deadline() = (%v, %v), want (%v, true)", gotDeadline, ok, parentDeadline)
+	}
+
+	// parentの方が先にdeadlineを迎えるので、子もそれにあわせてcancelされる
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("ctx was not canceled after the parent's earlier deadline elapsed")
+	}
+
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Fatalf("ctx.Err() = %v, want %v", err, DeadlineExceeded)
+	}
+}
+
+func TestWithTimeoutCancelAfterFireIsNoop(t *testing.T) {
+	ctx, cancel := WithTimeout(Background(), 10*time.Millisecond)
+
+	<-ctx.Done()
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Fatalf("ctx.Err() = %v, want %v", err, DeadlineExceeded)
+	}
+
+	// すでにtimerが発火した後にcancelを呼んでもpanicしたりerrが上書きされたりしない
+	cancel()
+
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Fatalf("ctx.Err() after late cancel() = %v, want %v", err, DeadlineExceeded)
+	}
+}
+
+func TestDeadlineExceededSatisfiesNetError(t *testing.T) {
+	netErr, ok := DeadlineExceeded.(interface {
+		Timeout() bool
+		Temporary() bool
+	})
+	if !ok {
+		t.Fatal("DeadlineExceeded does not implement Timeout()/Temporary()")
+	}
+	if !netErr.Timeout() {
+		t.Fatal("DeadlineExceeded.Timeout() = false, want true")
+	}
+	if !netErr.Temporary() {
+		t.Fatal("DeadlineExceeded.Temporary() = false, want true")
+	}
+}
+
+func buildValueChain(depth int) Context {
+	ctx := Context(Background())
+	for i := 0; i < depth; i++ {
+		ctx = WithValue(ctx, i, i)
+	}
+	return ctx
+}
+
+// BenchmarkValueLookup はWithValueのチェーンの深さごとに、
+// キャッシュを使った場合と使わない場合(線形探索)のValue呼び出しを比較します
+func BenchmarkValueLookup(b *testing.B) {
+	defer SetValueCacheThreshold(8)
+
+	for _, depth := range []int{4, 16, 64, 256} {
+		depth := depth
+		wantKey := 0 // 最も奥にあるkeyを引くことで線形探索ではチェーン全体を辿らせる
+
+		b.Run(fmt.Sprintf("linear/depth=%d", depth), func(b *testing.B) {
+			SetValueCacheThreshold(depth + 1) // キャッシュを無効化する
+			ctx := buildValueChain(depth)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = ctx.Value(wantKey)
+			}
+		})
+
+		b.Run(fmt.Sprintf("cached/depth=%d", depth), func(b *testing.B) {
+			SetValueCacheThreshold(1) // どの深さでもキャッシュを有効にする
+			ctx := buildValueChain(depth)
+			_ = ctx.Value(wantKey) // キャッシュを温める
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = ctx.Value(wantKey)
+			}
+		})
+	}
+}
+
+func TestValueCacheMatchesLinearLookup(t *testing.T) {
+	defer SetValueCacheThreshold(8)
+	SetValueCacheThreshold(4)
+
+	ctx := buildValueChain(16)
+	for i := 0; i < 16; i++ {
+		if got := ctx.Value(i); got != i {
+			t.Fatalf("ctx.Value(%d) = %v, want %d", i, got, i)
+		}
+	}
+	if got := ctx.Value("missing"); got != nil {
+		t.Fatalf("ctx.Value(missing) = %v, want nil", got)
+	}
+}
+
+func TestValueCacheCrossesTimerCtxBoundary(t *testing.T) {
+	defer SetValueCacheThreshold(8)
+	SetValueCacheThreshold(1)
+
+	type key int
+
+	ctx := Context(Background())
+	for i := 0; i < 4; i++ {
+		ctx = WithValue(ctx, key(i), i)
+	}
+
+	deadlineCtx, cancel := WithDeadline(ctx, time.Now().Add(time.Hour))
+	defer cancel()
+
+	ctx = WithValue(deadlineCtx, key(100), 100)
+
+	// depthがしきい値以上なのでcacheが使われるが、
+	// 祖先のWithValueはtimerCtxを挟んでいるので正しく辿れる必要がある
+	for i := 0; i < 4; i++ {
+		if got := ctx.Value(key(i)); got != i {
+			t.Fatalf("ctx.Value(key(%d)) = %v, want %d (WithValue above a WithDeadline boundary was lost)", i, got, i)
+		}
+	}
+}
+
+func TestPropagateCancelNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	parent := &fakeCtx{done: make(chan struct{})}
+	_, cancelChild := WithCancel(parent)
+	cancelChild()
+
+	// 監視用goroutineが終了するまで少し待つ
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leaked: before=%d after=%d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPropagateCancelNoGoroutineLeakWhenParentCancelsFirst(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	parent := &fakeCtx{done: make(chan struct{})}
+	child, _ := WithCancel(parent)
+
+	// 子ではなく親(third-party Context)側のDoneを先に閉じる
+	parent.err = Canceled
+	close(parent.done)
+
+	select {
+	case <-child.Done():
+	case <-time.After(time.Second):
+		t.Fatal("child was not canceled after parent's Done channel closed")
+	}
+
+	// 監視用goroutineが終了するまで少し待つ
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leaked: before=%d after=%d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
\ No newline at end of file